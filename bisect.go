@@ -0,0 +1,215 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// bisectRevResult records how a single revision scored against a specific
+// build type/runs/fail-threshold configuration: how many of the runs
+// failed, and the resulting git-bisect verdict.
+type bisectRevResult struct {
+	Revision  string
+	Sha       string
+	BuildType string
+	Runs      int
+	Threshold int
+	Fails     int
+	Verdict   string // "good" or "bad"
+}
+
+func bisectCacheDir() (string, error) {
+	base, err := os.UserCacheDir()
+	if err != nil {
+		return "", err
+	}
+	dir := filepath.Join(base, "teamcityrun", "bisect")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", err
+	}
+	return dir, nil
+}
+
+// bisectCacheKey identifies a cached verdict for a diff scored under a
+// particular buildType/runs/threshold configuration. The same diff can
+// score differently under a different configuration, so all of them must
+// match before a cached verdict is reused.
+func bisectCacheKey(sha, buildType string, runs, threshold int) string {
+	return sha256Hex([]byte(fmt.Sprintf("%s|%s|%d|%d", sha, buildType, runs, threshold)))
+}
+
+// lookupBisectResult returns a previously computed verdict for key, if any,
+// so that resuming a bisect after a crash doesn't re-trigger builds for
+// revisions already scored under the same configuration.
+func lookupBisectResult(key string) (*bisectRevResult, error) {
+	dir, err := bisectCacheDir()
+	if err != nil {
+		return nil, err
+	}
+	buf, err := ioutil.ReadFile(filepath.Join(dir, key+".json"))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var res bisectRevResult
+	if err := json.Unmarshal(buf, &res); err != nil {
+		return nil, err
+	}
+	return &res, nil
+}
+
+func storeBisectResult(key string, res *bisectRevResult) error {
+	dir, err := bisectCacheDir()
+	if err != nil {
+		return err
+	}
+	buf, err := json.Marshal(res)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(dir, key+".json"), buf, 0644)
+}
+
+// bisectCachePurge removes every cached bisect verdict, so a user who hits
+// a poisoned cache (e.g. a revision wrongly scored during a run that was
+// later interrupted) has a way out short of manual filesystem surgery.
+func bisectCachePurge() {
+	dir, err := bisectCacheDir()
+	must(err)
+	must(os.RemoveAll(dir))
+	fmt.Printf("removed %s\n", dir)
+}
+
+func gitRevParseHead() (string, error) {
+	out, err := exec.Command("git", "rev-parse", "HEAD").Output()
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+func gitBisect(args ...string) error {
+	out, err := exec.Command("git", append([]string{"bisect"}, args...)...).CombinedOutput()
+	os.Stdout.Write(out)
+	if err != nil {
+		return fmt.Errorf("git bisect %s: %w", strings.Join(args, " "), err)
+	}
+	return nil
+}
+
+// scoreRevision diffs the currently checked-out revision against master,
+// uploads and triggers it runs times, and reports it bad if at least
+// threshold of those runs failed. A revision whose diff has already been
+// scored under this exact buildType/runs/threshold is not re-triggered.
+//
+// An error from a build itself (a wait timeout, or ctx being cancelled by
+// the user's own Ctrl-C) is not a verdict: it's returned to the caller
+// uncached, rather than being counted as a failing run, so a cancelled
+// bisect can be resumed without having poisoned the cache.
+func scoreRevision(ctx context.Context, buildType string, runs, threshold int, timeout time.Duration) (*bisectRevResult, error) {
+	rev, err := gitRevParseHead()
+	if err != nil {
+		return nil, err
+	}
+
+	diff := getdiff()
+	sha := sha256Hex(diff)
+	key := bisectCacheKey(sha, buildType, runs, threshold)
+
+	if cached, err := lookupBisectResult(key); err == nil && cached != nil {
+		fmt.Printf("%s: reusing cached result %s (%d/%d failed)\n", rev, cached.Verdict, cached.Fails, cached.Runs)
+		return cached, nil
+	}
+
+	id, _, err := uploadPatchCached(ctx, fmt.Sprintf("bisect-%s", rev), diff)
+	if err != nil {
+		return nil, err
+	}
+
+	buildIds := make([]string, 0, runs)
+	for i := 0; i < runs; i++ {
+		bs, err := triggerBuild(ctx, buildType, id)
+		if err != nil {
+			return nil, err
+		}
+		buildIds = append(buildIds, strconv.Itoa(bs.Id))
+	}
+
+	results := waitForBuilds(ctx, buildIds, timeout)
+	fails := 0
+	for _, r := range results {
+		if r.Err != nil {
+			return nil, fmt.Errorf("waiting for build %s: %w", r.Id, r.Err)
+		}
+		if r.Status.Status != "SUCCESS" {
+			fails++
+		}
+	}
+
+	verdict := "good"
+	if fails >= threshold {
+		verdict = "bad"
+	}
+	fmt.Printf("%s: %s (%d/%d failed)\n", rev, verdict, fails, runs)
+
+	res := &bisectRevResult{Revision: rev, Sha: sha, BuildType: buildType, Runs: runs, Threshold: threshold, Fails: fails, Verdict: verdict}
+	if err := storeBisectResult(key, res); err != nil {
+		fmt.Fprintf(os.Stderr, "warning: could not persist bisect result: %s\n", err)
+	}
+	return res, nil
+}
+
+// runBisect drives `git bisect` between goodRev and badRev, scoring each
+// candidate revision by triggering buildTypeRegex runs times per revision
+// and requiring at least threshold of those runs to fail before calling
+// the revision bad.
+func runBisect(ctx context.Context, goodRev, badRev, buildTypeRegex string, runs, threshold int, timeout time.Duration) error {
+	re := regexp.MustCompile("(?i:" + buildTypeRegex + ")")
+	bts := []string{}
+	for _, bt := range getBuildTypes() {
+		if re.MatchString(bt) {
+			bts = append(bts, bt)
+		}
+	}
+	if len(bts) != 1 {
+		return fmt.Errorf("bisect requires exactly one build type match, got %d", len(bts))
+	}
+	buildType := bts[0]
+
+	if err := gitBisect("start"); err != nil {
+		return err
+	}
+	if err := gitBisect("bad", badRev); err != nil {
+		return err
+	}
+	if err := gitBisect("good", goodRev); err != nil {
+		return err
+	}
+
+	for {
+		res, err := scoreRevision(ctx, buildType, runs, threshold, timeout)
+		if err != nil {
+			return err
+		}
+
+		out, err := exec.Command("git", "bisect", res.Verdict).CombinedOutput()
+		os.Stdout.Write(out)
+		if err != nil {
+			return fmt.Errorf("git bisect %s: %w", res.Verdict, err)
+		}
+		if strings.Contains(string(out), "is the first bad commit") {
+			return nil
+		}
+	}
+}
@@ -0,0 +1,174 @@
+// Package logsink provides a small self-rotating file writer for saving
+// streamed build logs to disk.
+package logsink
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+const currentName = "current.log"
+
+// RotatingWriter is an io.Writer that appends to a file under Dir, rotating
+// to a new numbered segment once MaxSize bytes have been written and
+// pruning segments beyond MaxFiles. Rotation renames the active file, so a
+// reader watching the directory never sees a partially-named segment.
+type RotatingWriter struct {
+	Dir      string
+	MaxSize  int64
+	MaxFiles int
+
+	mu         sync.Mutex
+	f          *os.File
+	written    int64
+	seq        int
+	priorBytes int64 // bytes already on disk in segment files at construction time
+}
+
+// NewRotatingWriter creates a RotatingWriter writing into dir, creating it
+// if necessary. If dir already contains segment files from a previous run,
+// numbering resumes after the highest one found, so reopening the same dir
+// never overwrites existing segments.
+func NewRotatingWriter(dir string, maxSize int64, maxFiles int) (*RotatingWriter, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	seq, err := highestSegmentSeq(dir)
+	if err != nil {
+		return nil, err
+	}
+	priorBytes, err := segmentBytesOnDisk(dir)
+	if err != nil {
+		return nil, err
+	}
+	w := &RotatingWriter{Dir: dir, MaxSize: maxSize, MaxFiles: maxFiles, seq: seq, priorBytes: priorBytes}
+	if err := w.openCurrent(); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+// highestSegmentSeq returns the largest sequence number among dir's existing
+// segment-NNNN.log files, or 0 if there are none.
+func highestSegmentSeq(dir string) (int, error) {
+	matches, err := filepath.Glob(filepath.Join(dir, "segment-*.log"))
+	if err != nil {
+		return 0, err
+	}
+	seq := 0
+	for _, m := range matches {
+		var n int
+		if _, err := fmt.Sscanf(filepath.Base(m), "segment-%04d.log", &n); err == nil && n > seq {
+			seq = n
+		}
+	}
+	return seq, nil
+}
+
+// segmentBytesOnDisk returns the total size of dir's existing segment-*.log
+// files, so BytesWritten can report a caller's true cumulative offset into
+// the source the writer is recording, across restarts.
+func segmentBytesOnDisk(dir string) (int64, error) {
+	matches, err := filepath.Glob(filepath.Join(dir, "segment-*.log"))
+	if err != nil {
+		return 0, err
+	}
+	var total int64
+	for _, m := range matches {
+		info, err := os.Stat(m)
+		if err != nil {
+			return 0, err
+		}
+		total += info.Size()
+	}
+	return total, nil
+}
+
+func (w *RotatingWriter) openCurrent() error {
+	f, err := os.OpenFile(filepath.Join(w.Dir, currentName), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	w.f = f
+	w.written = info.Size()
+	return nil
+}
+
+// Write appends p to the current segment, rotating first if appending it
+// would exceed MaxSize.
+func (w *RotatingWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.written > 0 && w.written+int64(len(p)) > w.MaxSize {
+		if err := w.rotate(); err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := w.f.Write(p)
+	w.written += int64(n)
+	return n, err
+}
+
+func (w *RotatingWriter) rotate() error {
+	if err := w.f.Close(); err != nil {
+		return err
+	}
+
+	w.seq++
+	rotated := filepath.Join(w.Dir, fmt.Sprintf("segment-%04d.log", w.seq))
+	if err := os.Rename(filepath.Join(w.Dir, currentName), rotated); err != nil {
+		return err
+	}
+	w.priorBytes += w.written
+
+	if err := w.prune(); err != nil {
+		return err
+	}
+
+	return w.openCurrent()
+}
+
+func (w *RotatingWriter) prune() error {
+	if w.MaxFiles <= 0 {
+		return nil
+	}
+	matches, err := filepath.Glob(filepath.Join(w.Dir, "segment-*.log"))
+	if err != nil {
+		return err
+	}
+	sort.Strings(matches)
+	for len(matches) > w.MaxFiles {
+		if err := os.Remove(matches[0]); err != nil {
+			return err
+		}
+		matches = matches[1:]
+	}
+	return nil
+}
+
+// Close flushes and closes the current segment file.
+func (w *RotatingWriter) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.f.Close()
+}
+
+// BytesWritten returns the total bytes recorded so far across the current
+// segment and any prior ones, including segments found on disk from an
+// earlier run. Callers resuming a source they're only allowed to read
+// incrementally (e.g. an HTTP Range request) use this as their offset.
+func (w *RotatingWriter) BytesWritten() int64 {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.priorBytes + w.written
+}
@@ -0,0 +1,291 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// logline is a single parsed line of a TeamCity build log: a timestamp, an
+// indent level, zero or more tags (e.g. "Step 2/2", "Test Output") and the
+// remaining text.
+type logline struct {
+	raw     string
+	time    int
+	indent  int
+	tags    []string
+	text    string
+	addtext string
+}
+
+// testEvent is a single `go test -json` action line.
+type testEvent struct {
+	Time    string
+	Action  string
+	Package string
+	Test    string
+	Elapsed float64 // seconds
+	Output  string
+}
+
+func logparse(line string) *logline {
+	rest := line
+
+	perr := func(reason string) {
+		panic(fmt.Errorf("could not parse %q: %s", line, reason))
+	}
+
+	expectByte := func(b byte) {
+		if len(rest) == 0 || rest[0] != b {
+			perr(fmt.Sprintf("expecting %c", b))
+		}
+		rest = rest[1:]
+	}
+
+	expectLen := func(n int) string {
+		if len(rest) < n {
+			perr(fmt.Sprintf("expecting %d characters", n))
+		}
+		r := rest[:n]
+		rest = rest[n:]
+		return r
+	}
+
+	consumeMaybe := func(b byte) {
+		if len(rest) > 0 && rest[0] == b {
+			rest = rest[1:]
+		}
+	}
+
+	if len(line) > 0 && line[0] != '[' {
+		return nil
+	}
+
+	var ll logline
+
+	ll.raw = line
+
+	// timestamp
+	expectByte('[')
+	hour, _ := strconv.Atoi(expectLen(2))
+	expectByte(':')
+	minute, _ := strconv.Atoi(expectLen(2))
+	expectByte(':')
+	second, _ := strconv.Atoi(expectLen(2))
+	expectByte(']')
+
+	ll.time = hour*60*60 + minute*60 + second
+
+	expectLen(1) // flags?
+	expectByte(':')
+
+	// indentation
+	for len(rest) > 0 && rest[0] == '\t' {
+		ll.indent++
+		rest = rest[1:]
+	}
+
+	// tags
+	for {
+		consumeMaybe(' ')
+		if len(rest) <= 0 || rest[0] != '[' {
+			break
+		}
+
+		rest = rest[1:]
+		found := false
+		for i := 0; i < len(rest); i++ {
+			if rest[i] == ']' {
+				ll.tags = append(ll.tags, rest[:i])
+				rest = rest[i+1:]
+				found = true
+				break
+			}
+		}
+		if !found {
+			break
+		}
+	}
+
+	ll.text = rest
+
+	return &ll
+}
+
+// LogEventKind identifies the kind of event yielded by logTokenizer.
+type LogEventKind int
+
+const (
+	EventHeaderLine LogEventKind = iota
+	EventStepBoundary
+	EventTestOutput
+	EventTestResult
+	EventRawLine
+)
+
+// TestResult is a single `go test -json` action line, decoded from a build
+// step's output.
+type TestResult struct {
+	Pkg     string
+	Test    string
+	Action  string
+	Elapsed float64
+	Output  string
+}
+
+// LogEvent is a single typed event produced by walking a TeamCity build
+// log. Reporters decide what to do with each event; the tokenizer only
+// classifies.
+type LogEvent struct {
+	Kind LogEventKind
+
+	Time int      // seconds-since-midnight; unset for EventHeaderLine
+	Tags []string // tag stack in effect; unset for EventHeaderLine
+
+	Raw  string // the original, unprocessed line
+	Text string // massaged body text (HeaderLine, StepBoundary, RawLine)
+
+	Unparsed bool   // EventRawLine only: line didn't start with a timestamp
+	Forced   bool   // EventHeaderLine only: always shown, regardless of -v level ("Current time: " footer)
+	Boundary string // EventStepBoundary only: "dwz", "maketest" or "patch"
+
+	TestOutput string      // EventTestOutput: the captured output line
+	TestResult *TestResult // EventTestResult
+}
+
+// logTokenizer walks a TeamCity build log, one event at a time. It owns
+// the tag/indent stack and marks dwz/make-test/patch step boundaries (the
+// state those boundaries switch is kept by the reporter); it is a pure
+// iterator and makes no decision about what should be displayed.
+type logTokenizer struct {
+	s     *bufio.Scanner
+	stack []string
+
+	inHeader  bool
+	done      bool
+	keepGoing bool // don't stop early at the tests-processed/current-time sentinels; read to EOF
+}
+
+func newLogTokenizer(r io.Reader) *logTokenizer {
+	return &logTokenizer{s: bufio.NewScanner(r), stack: make([]string, 0, 20), inHeader: true}
+}
+
+func (t *logTokenizer) treeize(ll *logline) {
+	pl := len(t.stack)
+	t.stack = t.stack[:ll.indent]
+	for i := pl; i < len(t.stack); i++ {
+		t.stack[i] = ""
+	}
+	for i := range ll.tags {
+		t.stack[len(t.stack)-len(ll.tags)+i] = ll.tags[i]
+	}
+}
+
+func (t *logTokenizer) topOfStackIs(s string) bool {
+	return len(t.stack) > 0 && t.stack[len(t.stack)-1] == s
+}
+
+func (t *logTokenizer) stackHas(s string) bool {
+	for _, z := range t.stack {
+		if z == s {
+			return true
+		}
+	}
+	return false
+}
+
+func (t *logTokenizer) tags() []string {
+	return append([]string(nil), t.stack...)
+}
+
+// Next returns the next event from the log, or ok=false once the log is
+// exhausted.
+func (t *logTokenizer) Next() (LogEvent, bool) {
+	if t.done {
+		return LogEvent{}, false
+	}
+
+	if t.inHeader {
+		if !t.s.Scan() {
+			t.done = true
+			return LogEvent{}, false
+		}
+		line := t.s.Text()
+		if line == "" {
+			t.inHeader = false
+			return t.Next()
+		}
+		return LogEvent{Kind: EventHeaderLine, Raw: line, Text: line}, true
+	}
+
+	if !t.s.Scan() {
+		t.done = true
+		return LogEvent{}, false
+	}
+	line := t.s.Text()
+
+	if strings.HasSuffix(line, " tests processed.") {
+		if !t.keepGoing {
+			t.done = true
+		}
+		return LogEvent{Kind: EventHeaderLine, Raw: line, Text: line}, true
+	}
+
+	if strings.HasPrefix(line, "Current time: ") {
+		if !t.keepGoing {
+			t.done = true
+		}
+		return LogEvent{Kind: EventHeaderLine, Raw: line, Text: line, Forced: true}, true
+	}
+
+	ll := logparse(line)
+	if ll == nil {
+		return LogEvent{Kind: EventRawLine, Raw: line, Unparsed: true}, true
+	}
+	t.treeize(ll)
+
+	if t.topOfStackIs("Test Output") {
+		if !t.s.Scan() {
+			t.done = true
+			return LogEvent{}, false
+		}
+		return LogEvent{Kind: EventTestOutput, Raw: line, Time: ll.time, Tags: t.tags(), TestOutput: t.s.Text()}, true
+	}
+
+	buildStep := t.topOfStackIs("Step 2/2") || t.topOfStackIs("Step 1/1")
+
+	if buildStep && len(ll.text) > 0 && ll.text[0] == '{' {
+		te := &testEvent{}
+		if err := json.Unmarshal([]byte(ll.text), te); err == nil && te.Action != "" {
+			return LogEvent{
+				Kind: EventTestResult,
+				Raw:  line,
+				Time: ll.time,
+				Tags: t.tags(),
+				TestResult: &TestResult{
+					Pkg:     te.Package,
+					Test:    te.Test,
+					Action:  te.Action,
+					Elapsed: te.Elapsed,
+					Output:  te.Output,
+				},
+			}, true
+		}
+	}
+
+	if buildStep {
+		switch {
+		case strings.HasPrefix(ll.text, "+ dwz --version"):
+			return LogEvent{Kind: EventStepBoundary, Raw: line, Time: ll.time, Tags: t.tags(), Text: ll.text, Boundary: "dwz"}, true
+		case strings.HasPrefix(ll.text, "+ make test"):
+			return LogEvent{Kind: EventStepBoundary, Raw: line, Time: ll.time, Tags: t.tags(), Text: ll.text, Boundary: "maketest"}, true
+		case strings.HasPrefix(ll.text, "Finding latest patch"):
+			return LogEvent{Kind: EventStepBoundary, Raw: line, Time: ll.time, Tags: t.tags(), Text: ll.text, Boundary: "patch"}, true
+		}
+	}
+
+	return LogEvent{Kind: EventRawLine, Raw: line, Time: ll.time, Tags: t.tags(), Text: ll.text}, true
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/aarzilli/teamcityrun/internal/logsink"
+)
+
+// tailPollInterval is how often tailBuild checks for new log bytes once it
+// has caught up with what's been written so far.
+const tailPollInterval = 2 * time.Second
+
+// downloadLogRange fetches the build log starting at offset, using a Range
+// request so only the bytes produced since the last call are transferred.
+func downloadLogRange(ctx context.Context, buildId int, offset int64) (io.ReadCloser, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", fmt.Sprintf("https://%s/downloadBuildLog.html?buildId=%d", TEAMCITY_HOST, buildId), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Add("Authorization", fmt.Sprintf("Bearer %s", TEAMCITY_TOKEN))
+	req.Header.Add("Accept", "text/text")
+	if offset > 0 {
+		req.Header.Add("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusPartialContent {
+		resp.Body.Close()
+		return nil, fmt.Errorf("unexpected status downloading log: %s", resp.Status)
+	}
+	return resp.Body, nil
+}
+
+// tailBuild streams buildId's log incrementally until the build finishes or
+// ctx is cancelled: it repeatedly fetches whatever bytes have been appended
+// since the last offset, appends them to a rotating file under dir, and
+// pipes them through cleanupLog for live, massaged output. If dir already
+// holds bytes from an earlier run, downloading resumes after them instead
+// of re-fetching the whole log from the start.
+func tailBuild(ctx context.Context, buildId int, verbose int, dir string) error {
+	rot, err := logsink.NewRotatingWriter(dir, 10*1024*1024, 10)
+	if err != nil {
+		return err
+	}
+	defer rot.Close()
+
+	pr, pw := io.Pipe()
+	done := make(chan struct{})
+	go func() {
+		cleanupLog(pr, verbose)
+		close(done)
+		// The tokenizer can decide it's done (e.g. it hit the "tests
+		// processed." footer) before the download loop below is finished
+		// writing to pw. Keep draining pr so those later writes never block
+		// on a reader that's gone.
+		io.Copy(io.Discard, pr)
+	}()
+
+	streamErr := func() error {
+		offset := rot.BytesWritten()
+		for {
+			body, err := downloadLogRange(ctx, buildId, offset)
+			if err != nil {
+				return err
+			}
+			n, err := io.Copy(io.MultiWriter(rot, pw), body)
+			body.Close()
+			offset += n
+			if err != nil {
+				return err
+			}
+
+			if n == 0 {
+				bs, err := fetchBuildStatus(ctx, strconv.Itoa(buildId))
+				if err != nil {
+					return err
+				}
+				if bs.State == "finished" {
+					return nil
+				}
+			}
+
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(tailPollInterval):
+			}
+		}
+	}()
+
+	pw.CloseWithError(streamErr)
+	<-done
+	return streamErr
+}
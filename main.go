@@ -2,6 +2,7 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -9,28 +10,50 @@ import (
 	"net/http"
 	"os"
 	"os/exec"
+	"os/signal"
+	"path/filepath"
 	"regexp"
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"text/tabwriter"
 	"time"
 )
 
 func usage() {
 	fmt.Fprintf(os.Stderr, `Usage:
-	
-	teamcityrun <regex>		runs current diff on all build types matched (case insensitive) by regex
+
+	teamcityrun <regex> [-wait] [-tail] [-timeout=30m]
+					runs current diff on all build types matched (case insensitive) by regex
+					with -wait, blocks until all triggered builds finish and reports pass/fail
+					with -tail, streams the triggered build's log live (requires a single match)
+	teamcityrun wait <build-id>... [-timeout=30m]
+					blocks until the given builds finish and reports pass/fail
+	teamcityrun cache list		lists cached patch uploads
+	teamcityrun cache purge	removes all cached patch uploads
+	teamcityrun bisect <good-rev> <bad-rev> <build-type-regex> [-runs=N] [-fail-threshold=K] [-timeout=30m]
+					git bisects between good-rev and bad-rev, triggering build-type-regex
+					(must match exactly one build type) -runs times per revision and
+					calling it bad once at least -fail-threshold runs fail (default: all of them)
+	teamcityrun bisect cache purge	removes all cached bisect verdicts
 	teamcityrun buildtypes		lists all available build types
 	teamcityrun status <build-id>	shows status of build
 	teamcityrun status		shows status of the last 200 builds on the default branch
 	teamcityrun summary	shows summary of the last 200 builds
-	teamcityrun log <build-id> [-v] shows log for build, cleaned up, add more -v to clean up less
+	teamcityrun log <build-id> [-v] [-format=text|json|junit] [-out=file]
+					shows log for build, cleaned up, add more -v to clean up less
 					can also specify a text file instead of a build-id
+					-format=json streams one event per line; -format=junit writes
+					a JUnit XML report to -out (default junit.xml)
+	teamcityrun tail <build-id> [-v]
+					streams a running build's log live, saving the
+					transcript under ./teamcityrun-logs/<build-id>/
+					in 10 MiB segments, keeping the last 10
 	teamcityrun diff		shows current diff
 
 Environment variables TEAMCITY_TOKEN and TEAMCITY_HOST must be set.
-	
+
 `)
 	os.Exit(1)
 }
@@ -48,14 +71,20 @@ func must(err error) {
 
 var TEAMCITY_TOKEN, TEAMCITY_HOST string
 
+// rootCtx is cancelled when the user hits Ctrl-C, unblocking any in-flight
+// request or poll loop started from it.
+var rootCtx context.Context
+
 type hdopts struct {
 	ContentType string
 	Accept      string
 }
 
-func httpdo(method string, opts hdopts, path string, body io.Reader) *http.Response {
-	req, err := http.NewRequest(method, "https://"+TEAMCITY_HOST+path, body)
-	must(err)
+func httpdo(ctx context.Context, method string, opts hdopts, path string, body io.Reader) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, "https://"+TEAMCITY_HOST+path, body)
+	if err != nil {
+		return nil, err
+	}
 	req.Header.Add("Authorization", fmt.Sprintf("Bearer %s", TEAMCITY_TOKEN))
 	if opts.ContentType != "" {
 		req.Header.Add("Content-Type", opts.ContentType)
@@ -64,24 +93,30 @@ func httpdo(method string, opts hdopts, path string, body io.Reader) *http.Respo
 		req.Header.Add("Accept", opts.Accept)
 	}
 	req.Header.Add("Origin", TEAMCITY_HOST)
-	resp, err := http.DefaultClient.Do(req)
-	must(err)
-	return resp
+	return http.DefaultClient.Do(req)
 }
 
-func readall(body io.ReadCloser) []byte {
+func readall(body io.ReadCloser) ([]byte, error) {
 	buf, err := ioutil.ReadAll(body)
-	must(body.Close())
-	must(err)
-	return buf
+	if cerr := body.Close(); err == nil {
+		err = cerr
+	}
+	return buf, err
 }
 
-func uploadPatch(buildName string, diff []byte) string {
-	resp := httpdo("POST", hdopts{ContentType: "text/text"}, fmt.Sprintf("/uploadDiffChanges.html?description=%s&commitType=0", buildName), bytes.NewReader(diff))
-	return strings.TrimSpace(string(readall(resp.Body)))
+func uploadPatch(ctx context.Context, buildName string, diff []byte) (string, error) {
+	resp, err := httpdo(ctx, "POST", hdopts{ContentType: "text/text"}, fmt.Sprintf("/uploadDiffChanges.html?description=%s&commitType=0", buildName), bytes.NewReader(diff))
+	if err != nil {
+		return "", err
+	}
+	buf, err := readall(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(buf)), nil
 }
 
-func triggerBuild(buildTypeId, changeId string) {
+func triggerBuild(ctx context.Context, buildTypeId, changeId string) (*buildStatus, error) {
 	build := []byte(fmt.Sprintf(`<build personal="true">
   <triggered type='idePlugin' details='Unified Diff Patch'/>
   <triggeringOptions cleanSources="false" rebuildAllDependencies="false" queueAtTop="false"/>
@@ -90,10 +125,15 @@ func triggerBuild(buildTypeId, changeId string) {
     <change id="%s" personal="true"/>
   </lastChanges>
 </build>`, buildTypeId, changeId))
-	resp := httpdo("POST", hdopts{ContentType: "application/xml", Accept: "application/json"}, "/app/rest/buildQueue", bytes.NewReader(build))
-	buf := readall(resp.Body)
-	bs := decodeBuildStatus(bytes.NewReader(buf))
-	fmt.Printf("%s\n", bs.URL())
+	resp, err := httpdo(ctx, "POST", hdopts{ContentType: "application/xml", Accept: "application/json"}, "/app/rest/buildQueue", bytes.NewReader(build))
+	if err != nil {
+		return nil, err
+	}
+	buf, err := readall(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	return decodeBuildStatus(bytes.NewReader(buf))
 }
 
 func getdiff() []byte {
@@ -122,20 +162,33 @@ type buildStatus struct {
 	FinishOnAgentDate string
 }
 
-func decodeBuildStatus(rd io.Reader) *buildStatus {
+func decodeBuildStatus(rd io.Reader) (*buildStatus, error) {
 	var bs buildStatus
-	must(json.NewDecoder(rd).Decode(&bs))
-	return &bs
+	if err := json.NewDecoder(rd).Decode(&bs); err != nil {
+		return nil, err
+	}
+	return &bs, nil
 }
 
 func (bs *buildStatus) URL() string {
 	return fmt.Sprintf("https://%s/viewLog.html?buildId=%d", TEAMCITY_HOST, bs.Id)
 }
 
-func getBuildStatus(buildId string) {
-	resp := httpdo("GET", hdopts{ContentType: "application/json", Accept: "application/json"}, fmt.Sprintf("/app/rest/builds/id:%s", buildId), nil)
-	buf := readall(resp.Body)
-	bs := decodeBuildStatus(bytes.NewReader(buf))
+func fetchBuildStatus(ctx context.Context, buildId string) (*buildStatus, error) {
+	resp, err := httpdo(ctx, "GET", hdopts{ContentType: "application/json", Accept: "application/json"}, fmt.Sprintf("/app/rest/builds/id:%s", buildId), nil)
+	if err != nil {
+		return nil, err
+	}
+	buf, err := readall(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	return decodeBuildStatus(bytes.NewReader(buf))
+}
+
+func getBuildStatus(ctx context.Context, buildId string) {
+	bs, err := fetchBuildStatus(ctx, buildId)
+	must(err)
 	w := tabwriter.NewWriter(os.Stdout, 8, 8, 1, ' ', 0)
 	defer w.Flush()
 	fmt.Fprintf(w, "URL:\t%s\n", bs.URL())
@@ -154,7 +207,8 @@ func getBuildTypes() []string {
 		BuildType []buildType
 	}
 
-	resp := httpdo("GET", hdopts{Accept: "application/json"}, "/app/rest/buildTypes", nil)
+	resp, err := httpdo(rootCtx, "GET", hdopts{Accept: "application/json"}, "/app/rest/buildTypes", nil)
+	must(err)
 	defer resp.Body.Close()
 	var bts buildTypes
 	must(json.NewDecoder(resp.Body).Decode(&bts))
@@ -170,7 +224,8 @@ type buildStatusList struct {
 }
 
 func getBuildStatusAll() {
-	resp := httpdo("GET", hdopts{ContentType: "application/json", Accept: "application/json"}, fmt.Sprintf("/app/rest/builds?locator=count:200"), nil)
+	resp, err := httpdo(rootCtx, "GET", hdopts{ContentType: "application/json", Accept: "application/json"}, fmt.Sprintf("/app/rest/builds?locator=count:200"), nil)
+	must(err)
 	defer resp.Body.Close()
 	var bslist buildStatusList
 	must(json.NewDecoder(resp.Body).Decode(&bslist))
@@ -181,8 +236,20 @@ func getBuildStatusAll() {
 	}
 }
 
+func convStatus(s string) string {
+	switch s {
+	case "FAILURE":
+		return "FAIL"
+	case "SUCCESS":
+		return "OK"
+	default:
+		return s
+	}
+}
+
 func getBuildStatusSummary() {
-	resp := httpdo("GET", hdopts{ContentType: "application/json", Accept: "application/json"}, fmt.Sprintf("/app/rest/builds?locator=count:200"), nil)
+	resp, err := httpdo(rootCtx, "GET", hdopts{ContentType: "application/json", Accept: "application/json"}, fmt.Sprintf("/app/rest/builds?locator=count:200"), nil)
+	must(err)
 	defer resp.Body.Close()
 	var bslist buildStatusList
 	must(json.NewDecoder(resp.Body).Decode(&bslist))
@@ -205,17 +272,6 @@ func getBuildStatusSummary() {
 		}
 	}
 
-	conv := func(s string) string {
-		switch s {
-		case "FAILURE":
-			return "FAIL"
-		case "SUCCESS":
-			return "OK"
-		default:
-			return s
-		}
-	}
-
 	w := tabwriter.NewWriter(os.Stdout, 8, 8, 1, ' ', 0)
 	plats := map[string]struct{}{}
 	vers := map[string]struct{}{}
@@ -223,7 +279,7 @@ func getBuildStatusSummary() {
 	for _, btype := range btypes {
 		v := strings.SplitN(btype, "_", 4)
 		if len(v) != 4 || !strings.HasPrefix(btype, "Delve_") {
-			fmt.Fprintf(w, "%s\t%s\t%d/%d\n", btype, conv(bslast[btype]), bssucc[btype], bstot[btype])
+			fmt.Fprintf(w, "%s\t%s\t%d/%d\n", btype, convStatus(bslast[btype]), bssucc[btype], bstot[btype])
 			some = true
 			continue
 		}
@@ -256,7 +312,7 @@ func getBuildStatusSummary() {
 		for _, ver := range verstrs {
 			btype := fmt.Sprintf("Delve_%s_%s", strings.Replace(plat, "/", "_", -1), ver)
 			if bslast[btype] != "" {
-				fmt.Fprintf(w, "\t%s %d/%d", conv(bslast[btype]), bssucc[btype], bstot[btype])
+				fmt.Fprintf(w, "\t%s %d/%d", convStatus(bslast[btype]), bssucc[btype], bstot[btype])
 			} else {
 				fmt.Fprintf(w, "\t")
 			}
@@ -268,11 +324,113 @@ func getBuildStatusSummary() {
 
 }
 
+// buildWaitResult is the outcome of polling a single build to completion.
+type buildWaitResult struct {
+	Id     string
+	Status *buildStatus
+	Err    error
+}
+
+// waitForBuild polls a build's status until it transitions to "finished",
+// the per-build timeout elapses, or ctx is cancelled. Polls back off
+// exponentially, starting at 1s and capping at 30s.
+func waitForBuild(ctx context.Context, buildId string, timeout time.Duration) (*buildStatus, error) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	const (
+		initialBackoff = 1 * time.Second
+		maxBackoff     = 30 * time.Second
+	)
+	backoff := initialBackoff
+
+	for {
+		bs, err := fetchBuildStatus(ctx, buildId)
+		if err != nil {
+			return nil, err
+		}
+		if bs.State == "finished" {
+			return bs, nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(backoff):
+		}
+
+		backoff *= 2
+		if backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+	}
+}
+
+// waitForBuilds polls all of the given builds concurrently, one goroutine
+// per build, and returns once every poll has finished, errored or timed out.
+func waitForBuilds(ctx context.Context, buildIds []string, timeout time.Duration) []buildWaitResult {
+	results := make([]buildWaitResult, len(buildIds))
+	var wg sync.WaitGroup
+	for i, id := range buildIds {
+		wg.Add(1)
+		go func(i int, id string) {
+			defer wg.Done()
+			bs, err := waitForBuild(ctx, id, timeout)
+			results[i] = buildWaitResult{Id: id, Status: bs, Err: err}
+		}(i, id)
+	}
+	wg.Wait()
+	return results
+}
+
+// printWaitResults prints an aggregated pass/fail table and reports whether
+// every build succeeded.
+func printWaitResults(results []buildWaitResult) bool {
+	w := tabwriter.NewWriter(os.Stdout, 8, 8, 1, ' ', 0)
+	defer w.Flush()
+
+	allOk := true
+	for _, r := range results {
+		if r.Err != nil {
+			fmt.Fprintf(w, "%s\tERROR\t%s\n", r.Id, r.Err)
+			allOk = false
+			continue
+		}
+		if r.Status.Status != "SUCCESS" {
+			allOk = false
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\n", r.Id, convStatus(r.Status.Status), r.Status.URL())
+	}
+	return allOk
+}
+
+// parseTimeoutFlag scans args for a -timeout=<duration> flag, returning the
+// parsed duration (or def if absent) and the remaining args with the flag
+// removed.
+func parseTimeoutFlag(args []string, def time.Duration) (time.Duration, []string) {
+	timeout := def
+	rest := make([]string, 0, len(args))
+	for _, arg := range args {
+		if strings.HasPrefix(arg, "-timeout=") {
+			d, err := time.ParseDuration(strings.TrimPrefix(arg, "-timeout="))
+			must(err)
+			timeout = d
+			continue
+		}
+		rest = append(rest, arg)
+	}
+	return timeout, rest
+}
+
 func main() {
 	if len(os.Args) < 2 {
 		usage()
 	}
 
+	var stop context.CancelFunc
+	rootCtx, stop = signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
 	TEAMCITY_TOKEN = os.Getenv("TEAMCITY_TOKEN")
 	TEAMCITY_HOST = os.Getenv("TEAMCITY_HOST")
 
@@ -289,7 +447,7 @@ func main() {
 	switch os.Args[1] {
 	case "status":
 		if len(os.Args) > 2 {
-			getBuildStatus(os.Args[2])
+			getBuildStatus(rootCtx, os.Args[2])
 		} else {
 			getBuildStatusAll()
 		}
@@ -303,13 +461,78 @@ func main() {
 			fmt.Printf("%s\n", s)
 		}
 
+	case "cache":
+		if len(os.Args) < 3 {
+			usage()
+		}
+		switch os.Args[2] {
+		case "list":
+			cacheList()
+		case "purge":
+			cachePurge()
+		default:
+			usage()
+		}
+
+	case "bisect":
+		if len(os.Args) > 2 && os.Args[2] == "cache" {
+			if len(os.Args) < 4 || os.Args[3] != "purge" {
+				usage()
+			}
+			bisectCachePurge()
+			return
+		}
+
+		timeout, rest := parseTimeoutFlag(os.Args[2:], 30*time.Minute)
+		runs := 1
+		threshold := -1 // defaults to runs (unanimity) once parsed
+		args := make([]string, 0, len(rest))
+		for _, arg := range rest {
+			switch {
+			case strings.HasPrefix(arg, "-runs="):
+				n, err := strconv.Atoi(strings.TrimPrefix(arg, "-runs="))
+				must(err)
+				runs = n
+			case strings.HasPrefix(arg, "-fail-threshold="):
+				n, err := strconv.Atoi(strings.TrimPrefix(arg, "-fail-threshold="))
+				must(err)
+				threshold = n
+			default:
+				args = append(args, arg)
+			}
+		}
+		if len(args) != 3 {
+			usage()
+		}
+		if threshold < 0 {
+			threshold = runs
+		}
+		must(runBisect(rootCtx, args[0], args[1], args[2], runs, threshold, timeout))
+
+	case "wait":
+		timeout, buildIds := parseTimeoutFlag(os.Args[2:], 30*time.Minute)
+		if len(buildIds) == 0 {
+			usage()
+		}
+		results := waitForBuilds(rootCtx, buildIds, timeout)
+		if !printWaitResults(results) {
+			os.Exit(1)
+		}
+
 	case "log":
 		verbose := 0
+		format := "text"
+		outpath := ""
 		logarg := ""
 		for i := 2; i < len(os.Args); i++ {
-			if strings.HasPrefix(os.Args[i], "-v") {
+			switch {
+			case strings.HasPrefix(os.Args[i], "-format="):
+				format = strings.TrimPrefix(os.Args[i], "-format=")
+			case strings.HasPrefix(os.Args[i], "-out="):
+				outpath = strings.TrimPrefix(os.Args[i], "-out=")
+			case strings.HasPrefix(os.Args[i], "-v"):
 				verbose += len(os.Args[i]) - 1
-			} else {
+			default:
 				logarg = os.Args[i]
 			}
 		}
@@ -324,14 +547,50 @@ func main() {
 			logbody, err = os.Open(logarg)
 			must(err)
 		}
-		cleanupLog(logbody, verbose)
+		rep, err := newReporter(format, verbose, outpath)
+		must(err)
+		must(runReporter(logbody, rep))
+
+	case "tail":
+		verbose := 0
+		logarg := ""
+		for i := 2; i < len(os.Args); i++ {
+			if strings.HasPrefix(os.Args[i], "-v") {
+				verbose += len(os.Args[i]) - 1
+			} else {
+				logarg = os.Args[i]
+			}
+		}
+		if logarg == "" {
+			usage()
+		}
+		buildId, err := strconv.Atoi(logarg)
+		must(err)
+		must(tailBuild(rootCtx, buildId, verbose, filepath.Join("teamcityrun-logs", logarg)))
 
 	case "diff":
 		diff := getdiff()
 		os.Stdout.Write(diff)
 
 	default:
-		re := regexp.MustCompile("(?i:" + os.Args[1] + ")")
+		timeout, rest := parseTimeoutFlag(os.Args[1:], 30*time.Minute)
+		wait, tail := false, false
+		args := make([]string, 0, len(rest))
+		for _, arg := range rest {
+			switch arg {
+			case "-wait":
+				wait = true
+			case "-tail":
+				tail = true
+			default:
+				args = append(args, arg)
+			}
+		}
+		if len(args) != 1 {
+			usage()
+		}
+
+		re := regexp.MustCompile("(?i:" + args[0] + ")")
 		bts := []string{}
 		for _, bt := range getBuildTypes() {
 			if re.MatchString(bt) {
@@ -339,16 +598,40 @@ func main() {
 			}
 		}
 		if len(bts) == 0 {
-			fmt.Fprintf(os.Stderr, "no build types match %s\n", os.Args[1])
+			fmt.Fprintf(os.Stderr, "no build types match %s\n", args[0])
+			os.Exit(1)
+		}
+		if tail && len(bts) != 1 {
+			fmt.Fprintf(os.Stderr, "-tail requires exactly one build type match, got %d\n", len(bts))
 			os.Exit(1)
 		}
 
-		id := uploadPatch(time.Now().Format(time.RFC3339), getdiff())
-		fmt.Printf("Patch uploaded as %s\n", id)
+		id, cached, err := uploadPatchCached(rootCtx, time.Now().Format(time.RFC3339), getdiff())
+		must(err)
+		if !cached {
+			fmt.Printf("Patch uploaded as %s\n", id)
+		}
 
+		buildIds := make([]string, 0, len(bts))
 		for _, bt := range bts {
 			fmt.Printf("%s ", bt)
-			triggerBuild(bt, id)
+			bs, err := triggerBuild(rootCtx, bt, id)
+			must(err)
+			fmt.Printf("%s\n", bs.URL())
+			buildIds = append(buildIds, strconv.Itoa(bs.Id))
+		}
+
+		if tail {
+			tailId, err := strconv.Atoi(buildIds[0])
+			must(err)
+			must(tailBuild(rootCtx, tailId, 0, filepath.Join("teamcityrun-logs", buildIds[0])))
+		}
+
+		if wait {
+			results := waitForBuilds(rootCtx, buildIds, timeout)
+			if !printWaitResults(results) {
+				os.Exit(1)
+			}
 		}
 	}
 }
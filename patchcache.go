@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"text/tabwriter"
+	"time"
+)
+
+// patchCacheTTL is how long a cached patch upload is considered reusable
+// before it must be re-uploaded.
+const patchCacheTTL = 24 * time.Hour
+
+// patchCacheEntry records that a given diff's bytes were already uploaded
+// to a TeamCity host as a particular personal change.
+type patchCacheEntry struct {
+	Sha          string
+	ChangeId     string
+	UploadedAt   time.Time
+	TeamcityHost string
+}
+
+// patchCacheDir returns $XDG_CACHE_HOME/teamcityrun/patches (or the
+// platform-appropriate equivalent), creating it if necessary.
+func patchCacheDir() (string, error) {
+	base, err := os.UserCacheDir()
+	if err != nil {
+		return "", err
+	}
+	dir := filepath.Join(base, "teamcityrun", "patches")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", err
+	}
+	return dir, nil
+}
+
+func sha256Hex(buf []byte) string {
+	sum := sha256.Sum256(buf)
+	return hex.EncodeToString(sum[:])
+}
+
+func patchCacheEntryPath(dir, sha string) string {
+	return filepath.Join(dir, sha+".json")
+}
+
+// lookupPatchCache returns a cached, unexpired upload of diff for host, if
+// one exists.
+func lookupPatchCache(diff []byte, host string) (*patchCacheEntry, error) {
+	dir, err := patchCacheDir()
+	if err != nil {
+		return nil, err
+	}
+	sha := sha256Hex(diff)
+	buf, err := ioutil.ReadFile(patchCacheEntryPath(dir, sha))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var entry patchCacheEntry
+	if err := json.Unmarshal(buf, &entry); err != nil {
+		return nil, err
+	}
+	if entry.TeamcityHost != host {
+		return nil, nil
+	}
+	if time.Since(entry.UploadedAt) > patchCacheTTL {
+		return nil, nil
+	}
+	return &entry, nil
+}
+
+// storePatchCache records that diff was uploaded to host as changeId.
+func storePatchCache(diff []byte, host, changeId string) error {
+	dir, err := patchCacheDir()
+	if err != nil {
+		return err
+	}
+	entry := patchCacheEntry{
+		Sha:          sha256Hex(diff),
+		ChangeId:     changeId,
+		UploadedAt:   time.Now(),
+		TeamcityHost: host,
+	}
+	buf, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(patchCacheEntryPath(dir, entry.Sha), buf, 0644)
+}
+
+// uploadPatchCached uploads diff unless a cached, unexpired upload for the
+// current TEAMCITY_HOST already exists, in which case its changeId is
+// reused and cached is true.
+func uploadPatchCached(ctx context.Context, buildName string, diff []byte) (id string, cached bool, err error) {
+	if entry, err := lookupPatchCache(diff, TEAMCITY_HOST); err == nil && entry != nil {
+		fmt.Printf("Reusing cached patch upload %s\n", entry.ChangeId)
+		return entry.ChangeId, true, nil
+	}
+
+	id, err = uploadPatch(ctx, buildName, diff)
+	if err != nil {
+		return "", false, err
+	}
+	if err := storePatchCache(diff, TEAMCITY_HOST, id); err != nil {
+		fmt.Fprintf(os.Stderr, "warning: could not write patch cache entry: %s\n", err)
+	}
+	return id, false, nil
+}
+
+func listPatchCacheEntries() ([]patchCacheEntry, error) {
+	dir, err := patchCacheDir()
+	if err != nil {
+		return nil, err
+	}
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	entries := make([]patchCacheEntry, 0, len(files))
+	for _, f := range files {
+		if f.IsDir() {
+			continue
+		}
+		buf, err := ioutil.ReadFile(filepath.Join(dir, f.Name()))
+		if err != nil {
+			continue
+		}
+		var entry patchCacheEntry
+		if err := json.Unmarshal(buf, &entry); err != nil {
+			continue
+		}
+		entries = append(entries, entry)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].UploadedAt.After(entries[j].UploadedAt) })
+	return entries, nil
+}
+
+func cacheList() {
+	entries, err := listPatchCacheEntries()
+	must(err)
+	w := tabwriter.NewWriter(os.Stdout, 8, 8, 1, ' ', 0)
+	defer w.Flush()
+	for _, entry := range entries {
+		expired := ""
+		if time.Since(entry.UploadedAt) > patchCacheTTL {
+			expired = " (expired)"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s%s\n", entry.Sha[:12], entry.ChangeId, entry.TeamcityHost, entry.UploadedAt.Format(time.RFC3339), expired)
+	}
+}
+
+func cachePurge() {
+	dir, err := patchCacheDir()
+	must(err)
+	must(os.RemoveAll(dir))
+	fmt.Printf("removed %s\n", dir)
+}
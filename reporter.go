@@ -0,0 +1,317 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// Reporter consumes the LogEvent stream produced by logTokenizer and
+// renders it. Close is called once after the last event and should flush
+// or finalize any buffered output.
+type Reporter interface {
+	Report(ev LogEvent)
+	Close() error
+}
+
+// rawModer is implemented by reporters whose output should include
+// everything in the log through to EOF, bypassing the tokenizer's early
+// stop at the tests-processed/current-time sentinels (textReporter's
+// -vvv raw dump mode, whose whole point is "show everything").
+type rawModer interface {
+	rawMode() bool
+}
+
+// runReporter feeds every event from logbody through rep, in order.
+func runReporter(logbody io.Reader, rep Reporter) error {
+	t := newLogTokenizer(logbody)
+	if rm, ok := rep.(rawModer); ok {
+		t.keepGoing = rm.rawMode()
+	}
+	for {
+		ev, ok := t.Next()
+		if !ok {
+			break
+		}
+		rep.Report(ev)
+	}
+	return rep.Close()
+}
+
+func newReporter(format string, verbose int, outpath string) (Reporter, error) {
+	switch format {
+	case "", "text":
+		return newTextReporter(verbose), nil
+	case "json":
+		return newJSONReporter(), nil
+	case "junit":
+		if outpath == "" {
+			outpath = "junit.xml"
+		}
+		return newJUnitReporter(outpath), nil
+	default:
+		return nil, fmt.Errorf("unknown -format %q, want text, json or junit", format)
+	}
+}
+
+const (
+	verboseNothing       = iota
+	verboseGoTestVerbose // approximately equivalent to 'go test -v'
+	verboseTestOutput    // remove most of TeamCity output
+	verboseAllText
+)
+
+const (
+	modeRawText                = 1 << iota // shows the raw text of the output, no processing
+	modeShowHeader                         // show the TeamCity header
+	modeShowTestOutput                     // show entries marked with the [Test Output] tag
+	modeShowRoot                           // show entries without any tags
+	modeShowStep1                          // show entries marked with the [Step 1/2] tag (anywhere)
+	modeShowStep2                          // show entries marked with the [Step 2/2] tag (anywhere)
+	modeShowStep2Top                       // show entries marked with the [Step 2/2] tag (only if it's the topmost tag)
+	modeShowStep2OutputActions             // show all output actions in step2
+	modeSkipBeforeDwz                      // skip Step 2/2 messages that happen before the dwz message
+	modeSkipBeforeMakeTest                 // skip Step 2/2 messages that happen before the make test message
+	modeMassaged                           // show massaged format for modeShowStep1, modeShowStep2, modeShowHeader and modeShowTestOutput
+	modeShowOnlyFailed
+)
+
+func verboseMode(verbose int) uint16 {
+	switch verbose {
+	case verboseNothing:
+		return modeShowHeader | modeShowStep2Top | modeMassaged | modeSkipBeforeMakeTest | modeShowOnlyFailed
+	case verboseGoTestVerbose:
+		return modeShowHeader | modeShowStep2Top | modeShowStep2OutputActions | modeMassaged | modeSkipBeforeDwz
+	case verboseTestOutput:
+		return modeShowHeader | modeShowRoot | modeShowStep1 | modeShowStep2 | modeShowTestOutput | modeMassaged
+	default:
+		return modeRawText | modeShowHeader
+	}
+}
+
+// textReporter renders the original human-readable "massaged" view: a
+// ΔT-prefixed transcript that collapses TeamCity's own markup and, at the
+// default verbosity, only the output of failed tests.
+type textReporter struct {
+	w    io.Writer
+	mode uint16
+
+	afterDwz, afterMakeTest bool
+	first, firstMassaged    bool
+	lastTime                int
+	cached                  []LogEvent
+}
+
+func newTextReporter(verbose int) *textReporter {
+	return &textReporter{w: os.Stdout, mode: verboseMode(verbose), first: true, firstMassaged: true}
+}
+
+func (r *textReporter) rawMode() bool { return r.mode&modeRawText != 0 }
+
+func (r *textReporter) Report(ev LogEvent) {
+	if ev.Kind == EventHeaderLine {
+		if ev.Forced || r.mode&modeShowHeader != 0 {
+			fmt.Fprintf(r.w, "%s\n", ev.Text)
+		}
+		return
+	}
+
+	if r.mode&modeRawText != 0 {
+		fmt.Fprintf(r.w, "%s\n", ev.Raw)
+		if ev.Kind == EventTestOutput {
+			fmt.Fprintf(r.w, "%s\n", ev.TestOutput)
+		}
+		return
+	}
+
+	if ev.Kind == EventRawLine && ev.Unparsed {
+		return
+	}
+
+	if r.first {
+		r.first = false
+		r.lastTime = ev.Time
+	}
+
+	switch ev.Kind {
+	case EventRawLine:
+		r.renderBodyLine(ev.Tags, ev.Time, ev.Raw, ev.Text)
+	case EventStepBoundary:
+		switch ev.Boundary {
+		case "dwz":
+			r.afterDwz = true
+		case "maketest":
+			r.afterMakeTest = true
+		case "patch":
+			r.afterDwz, r.afterMakeTest = true, true
+		}
+		r.renderBodyLine(ev.Tags, ev.Time, ev.Raw, ev.Text)
+	case EventTestOutput:
+		if r.mode&modeShowTestOutput != 0 {
+			if r.mode&modeMassaged != 0 {
+				r.emitMassagedAt(ev.Time, ev.TestOutput)
+			} else {
+				fmt.Fprintf(r.w, "%s\n", ev.TestOutput)
+			}
+		}
+	case EventTestResult:
+		r.reportTestResult(ev)
+	}
+}
+
+func (r *textReporter) renderBodyLine(tags []string, evTime int, raw, text string) {
+	emitted := false
+
+	emitText := func() {
+		if emitted {
+			return
+		}
+		emitted = true
+		r.emitMassagedAt(evTime, text)
+	}
+
+	emitRaw := func() {
+		if emitted {
+			return
+		}
+		emitted = true
+		fmt.Fprintf(r.w, "%s\n", raw)
+	}
+
+	if r.mode&modeShowRoot != 0 && len(tags) == 0 {
+		if r.mode&modeMassaged != 0 {
+			emitText()
+		} else {
+			emitRaw()
+		}
+	}
+
+	if r.mode&modeShowStep1 != 0 && tagsHas(tags, "Step 1/2") {
+		if r.mode&modeMassaged != 0 {
+			emitText()
+		} else {
+			emitRaw()
+		}
+	}
+
+	if r.mode&(modeShowStep2|modeShowStep2Top) != 0 && (tagsHas(tags, "Step 2/2") || tagsHas(tags, "Step 1/1")) {
+		shouldShow := true
+		if r.mode&modeSkipBeforeDwz != 0 && !r.afterDwz {
+			shouldShow = false
+		}
+		if r.mode&modeShowStep2Top != 0 && !tagsTopIs(tags, "Step 2/2") {
+			shouldShow = false
+		}
+		if r.mode&modeSkipBeforeMakeTest != 0 && !r.afterMakeTest {
+			shouldShow = false
+		}
+		if shouldShow {
+			if r.mode&modeMassaged != 0 {
+				emitText()
+			} else {
+				emitRaw()
+			}
+		}
+	}
+
+	buildStep := tagsHas(tags, "Step 2/2") || tagsHas(tags, "Step 1/1")
+	if r.mode&modeShowOnlyFailed != 0 && buildStep && strings.HasPrefix(text, "Go ") {
+		emitText()
+	}
+}
+
+func (r *textReporter) reportTestResult(ev LogEvent) {
+	tr := ev.TestResult
+
+	if r.mode&modeShowStep2OutputActions != 0 && tr.Action == "output" {
+		r.emitMassagedAt(ev.Time, tr.Output)
+	}
+
+	if r.mode&modeShowOnlyFailed == 0 && tr.Action == "fail" && r.mode&modeShowStep2OutputActions == 0 {
+		r.emitMassagedAt(ev.Time, fmt.Sprintf("FAIL\t%s", tr.Pkg))
+	}
+
+	if r.mode&modeShowOnlyFailed != 0 {
+		r.reportOnlyFailed(ev)
+	}
+}
+
+// reportOnlyFailed replicates the default view's behavior: test output is
+// buffered per-package and only flushed if the package (or one of its
+// tests) ultimately fails.
+func (r *textReporter) reportOnlyFailed(ev LogEvent) {
+	tr := ev.TestResult
+
+	dumpCached := func() {
+		for _, c := range r.cached {
+			if c.TestResult.Action == "output" {
+				r.emitMassagedAt(c.Time, c.TestResult.Output)
+			}
+		}
+		r.cached = r.cached[:0]
+	}
+
+	r.cached = append(r.cached, ev)
+
+	if tr.Test == "" {
+		switch tr.Action {
+		case "pass":
+			r.emitMassagedAt(ev.Time, fmt.Sprintf("%s\t%gs", tr.Pkg, tr.Elapsed))
+			r.cached = r.cached[:0]
+		case "skip":
+			r.emitMassagedAt(ev.Time, fmt.Sprintf("%s\t[no test files]", tr.Pkg))
+			r.cached = r.cached[:0]
+		case "output":
+			// do nothing
+		case "fail":
+			dumpCached()
+			r.emitMassagedAt(ev.Time, fmt.Sprintf("%s\tFAIL", tr.Pkg))
+			r.cached = r.cached[:0]
+		default:
+			r.emitMassagedAt(ev.Time, fmt.Sprintf("%s\t%s", tr.Pkg, tr.Action))
+			r.cached = r.cached[:0]
+		}
+	} else {
+		switch tr.Action {
+		case "pass":
+			r.cached = r.cached[:0]
+		case "fail":
+			dumpCached()
+		}
+	}
+}
+
+func (r *textReporter) emitMassagedAt(t int, text string) {
+	if r.firstMassaged {
+		r.firstMassaged = false
+		fmt.Fprintf(r.w, "  ΔT\tTEXT\n")
+	}
+	if len(text) > 0 && text[len(text)-1] == '\n' {
+		text = text[:len(text)-1]
+		if len(text) > 0 && text[len(text)-1] == '\r' {
+			text = text[:len(text)-1]
+		}
+	}
+	if t-r.lastTime > 0 {
+		fmt.Fprintf(r.w, "% 4d\t%s\n", t-r.lastTime, text)
+	} else {
+		fmt.Fprintf(r.w, "    \t%s\n", text)
+	}
+	r.lastTime = t
+}
+
+func (r *textReporter) Close() error { return nil }
+
+func tagsTopIs(tags []string, s string) bool {
+	return len(tags) > 0 && tags[len(tags)-1] == s
+}
+
+func tagsHas(tags []string, s string) bool {
+	for _, z := range tags {
+		if z == s {
+			return true
+		}
+	}
+	return false
+}
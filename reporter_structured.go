@@ -0,0 +1,155 @@
+package main
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+// jsonReporter renders the event stream as newline-delimited JSON, one
+// object per event, suitable for piping into jq or another tool.
+type jsonReporter struct {
+	enc *json.Encoder
+}
+
+func newJSONReporter() *jsonReporter {
+	return &jsonReporter{enc: json.NewEncoder(os.Stdout)}
+}
+
+type jsonEvent struct {
+	Kind       string      `json:"kind"`
+	Time       int         `json:"time,omitempty"`
+	Tags       []string    `json:"tags,omitempty"`
+	Text       string      `json:"text,omitempty"`
+	TestOutput string      `json:"testOutput,omitempty"`
+	TestResult *TestResult `json:"testResult,omitempty"`
+}
+
+func (k LogEventKind) String() string {
+	switch k {
+	case EventHeaderLine:
+		return "header"
+	case EventStepBoundary:
+		return "stepBoundary"
+	case EventTestOutput:
+		return "testOutput"
+	case EventTestResult:
+		return "testResult"
+	case EventRawLine:
+		return "rawLine"
+	default:
+		return "unknown"
+	}
+}
+
+func (r *jsonReporter) Report(ev LogEvent) {
+	text := ev.Text
+	if ev.Kind == EventRawLine && ev.Unparsed {
+		text = ev.Raw
+	}
+	must(r.enc.Encode(jsonEvent{
+		Kind:       ev.Kind.String(),
+		Time:       ev.Time,
+		Tags:       ev.Tags,
+		Text:       text,
+		TestOutput: ev.TestOutput,
+		TestResult: ev.TestResult,
+	}))
+}
+
+func (r *jsonReporter) Close() error { return nil }
+
+// junitReporter accumulates go test results into a JUnit XML report,
+// written to path on Close.
+type junitReporter struct {
+	path  string
+	cases map[string]*junitCase
+	order []string
+}
+
+type junitCase struct {
+	pkg, test string
+	elapsed   float64
+	failed    bool
+	skipped   bool
+	output    strings.Builder
+}
+
+func newJUnitReporter(path string) *junitReporter {
+	return &junitReporter{path: path, cases: map[string]*junitCase{}}
+}
+
+func (r *junitReporter) Report(ev LogEvent) {
+	if ev.Kind != EventTestResult {
+		return
+	}
+	tr := ev.TestResult
+	if tr.Test == "" {
+		return // package-level result, not an individual test case
+	}
+
+	key := tr.Pkg + "." + tr.Test
+	c, ok := r.cases[key]
+	if !ok {
+		c = &junitCase{pkg: tr.Pkg, test: tr.Test}
+		r.cases[key] = c
+		r.order = append(r.order, key)
+	}
+
+	switch tr.Action {
+	case "output":
+		c.output.WriteString(tr.Output)
+	case "pass":
+		c.elapsed = tr.Elapsed
+	case "fail":
+		c.elapsed = tr.Elapsed
+		c.failed = true
+	case "skip":
+		c.skipped = true
+	}
+}
+
+type junitTestsuite struct {
+	XMLName   xml.Name        `xml:"testsuite"`
+	Tests     int             `xml:"tests,attr"`
+	Failures  int             `xml:"failures,attr"`
+	Skipped   int             `xml:"skipped,attr"`
+	TestCases []junitTestcase `xml:"testcase"`
+}
+
+type junitTestcase struct {
+	ClassName string        `xml:"classname,attr"`
+	Name      string        `xml:"name,attr"`
+	Time      float64       `xml:"time,attr"`
+	Failure   *junitMessage `xml:"failure,omitempty"`
+	Skipped   *junitMessage `xml:"skipped,omitempty"`
+}
+
+type junitMessage struct {
+	Text string `xml:",chardata"`
+}
+
+func (r *junitReporter) Close() error {
+	suite := junitTestsuite{Tests: len(r.order)}
+	for _, key := range r.order {
+		c := r.cases[key]
+		tc := junitTestcase{ClassName: c.pkg, Name: c.test, Time: c.elapsed}
+		if c.failed {
+			suite.Failures++
+			tc.Failure = &junitMessage{Text: c.output.String()}
+		}
+		if c.skipped {
+			suite.Skipped++
+			tc.Skipped = &junitMessage{}
+		}
+		suite.TestCases = append(suite.TestCases, tc)
+	}
+
+	buf, err := xml.MarshalIndent(suite, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(r.path, append([]byte(xml.Header), buf...), 0644)
+}